@@ -0,0 +1,73 @@
+// This file is part of fs1up.
+// Copyright (C) 2014 Andreas Klauer <Andreas.Klauer@metamorpher.de>
+// License: GPL-2
+
+package nbd
+
+// Extent describes a run of bytes within an export that share the same
+// status, as reported by BlockStatuser.
+type Extent struct {
+	Length uint32
+	Flags  uint32
+}
+
+// BlockStatuser is implemented by Devices that can report which parts of
+// themselves are holes or read as zero, so NBD_CMD_BLOCK_STATUS can answer
+// without reading the underlying data. Devices that don't implement it
+// are treated as fully allocated, non-zero data.
+type BlockStatuser interface {
+	BlockStatus(off, length int64) ([]Extent, error)
+}
+
+// Flusher is implemented by Devices that keep a writeback cache and can
+// flush it, answering NBD_CMD_FLUSH. Devices that don't implement it
+// don't advertise NBD_FLAG_SEND_FLUSH, and NBD_CMD_FLUSH fails if sent
+// anyway.
+type Flusher interface {
+	Flush() error
+}
+
+// Trimmer is implemented by Devices that can discard a range of bytes,
+// answering NBD_CMD_TRIM. Devices that don't implement it don't advertise
+// NBD_FLAG_SEND_TRIM.
+type Trimmer interface {
+	TrimAt(off, length int64) error
+}
+
+// ZeroWriter is implemented by Devices that can write zeroes without
+// transferring a zero-filled payload over the wire, answering
+// NBD_CMD_WRITE_ZEROES. noHole reflects the command's NBD_CMD_FLAG_NO_HOLE
+// bit: when true, ZeroAt must store real zero bytes rather than punching
+// a hole, so a later BlockStatus/extent query keeps reporting the range
+// as allocated. Devices that don't implement it still handle the
+// command, via a zero-filled WriteAt, which trivially honors NO_HOLE.
+type ZeroWriter interface {
+	ZeroAt(off, length int64, noHole bool) error
+}
+
+// FUAWriter is implemented by Devices that can honor a per-command Force
+// Unit Access flag, persisting a write before replying to it. Devices
+// that don't implement it don't advertise NBD_FLAG_SEND_FUA, and a write
+// is handled as if FUA had not been requested.
+type FUAWriter interface {
+	WriteAtFUA(b []byte, off int64, fua bool) (n int, err error)
+}
+
+// deviceFlags returns the NBD_FLAG_SEND_* bits to advertise for d, based
+// on which optional capability interfaces it implements.
+func deviceFlags(d Device) uint32 {
+	flags := uint32(NBD_FLAG_HAS_FLAGS)
+	if _, ok := d.(Flusher); ok {
+		flags |= NBD_FLAG_SEND_FLUSH
+	}
+	if _, ok := d.(Trimmer); ok {
+		flags |= NBD_FLAG_SEND_TRIM
+	}
+	if _, ok := d.(ZeroWriter); ok {
+		flags |= NBD_FLAG_SEND_WRITE_ZEROES
+	}
+	if _, ok := d.(FUAWriter); ok {
+		flags |= NBD_FLAG_SEND_FUA
+	}
+	return flags
+}
@@ -0,0 +1,247 @@
+// This file is part of fs1up.
+// Copyright (C) 2014 Andreas Klauer <Andreas.Klauer@metamorpher.de>
+// License: GPL-2
+
+package nbd
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// defaultMaxRequestSize bounds the largest NBD_CMD_READ, NBD_CMD_WRITE or
+// NBD_CMD_WRITE_ZEROES request handle() will accept unless
+// ServerOptions.MaxRequestSize says otherwise.
+const defaultMaxRequestSize = 2 << 19
+
+// job is one parsed NBD request, ready to be handed to a worker. writeData
+// holds the payload already drained from fd for NBD_CMD_WRITE; reads are
+// performed by the worker itself, into a buffer it owns.
+type job struct {
+	seq       uint64
+	req       request
+	writeData []byte
+	device    Device
+}
+
+// result is a job's encoded reply, tagged with its job's sequence number
+// so the writer goroutine can restore request order when needed.
+type result struct {
+	seq  uint64
+	data []byte
+}
+
+// dispatcher fans parsed requests out to a pool of workers and serializes
+// their replies back onto w through a single writer goroutine, so a slow
+// ReadAt/WriteAt no longer blocks parsing of the next request.
+type dispatcher struct {
+	w             io.Writer
+	structured    bool
+	metaContextID uint32
+	opts          ServerOptions
+
+	jobs chan job
+	done chan result
+	wg   sync.WaitGroup
+
+	writeMu sync.Mutex
+	writeWG sync.WaitGroup
+}
+
+func newDispatcher(w io.Writer, structured bool, metaContextID uint32, opts ServerOptions) *dispatcher {
+	n := opts.workers()
+	d := &dispatcher{
+		w:             w,
+		structured:    structured,
+		metaContextID: metaContextID,
+		opts:          opts,
+		jobs:          make(chan job, n),
+		done:          make(chan result, n),
+	}
+
+	d.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go d.work()
+	}
+	d.writeWG.Add(1)
+	go func() {
+		defer d.writeWG.Done()
+		d.writeLoop()
+	}()
+
+	return d
+}
+
+func (d *dispatcher) work() {
+	defer d.wg.Done()
+	for j := range d.jobs {
+		d.done <- result{seq: j.seq, data: processRequest(j, d.structured, d.metaContextID)}
+	}
+}
+
+// submit hands a parsed request to the worker pool. It may block until a
+// worker is free, which is fine: it runs on the reader goroutine and
+// applies natural backpressure to the client.
+func (d *dispatcher) submit(j job) {
+	d.jobs <- j
+}
+
+// close stops accepting new jobs and waits for in-flight ones to finish
+// and be written out before returning.
+func (d *dispatcher) close() {
+	close(d.jobs)
+	d.wg.Wait()
+	close(d.done)
+	d.writeWG.Wait()
+}
+
+// writeLoop drains completed replies and writes them to w. Unless
+// ServerOptions.OutOfOrder is set, it holds back replies that finished out
+// of turn in pending until the reply for the next expected sequence
+// number is ready, so clients that assume in-order delivery keep working.
+func (d *dispatcher) writeLoop() {
+	next := uint64(0)
+	pending := make(map[uint64][]byte)
+
+	for r := range d.done {
+		if d.opts.OutOfOrder {
+			d.writeOne(r.data)
+			continue
+		}
+
+		pending[r.seq] = r.data
+		for {
+			data, ok := pending[next]
+			if !ok {
+				break
+			}
+			d.writeOne(data)
+			delete(pending, next)
+			next++
+		}
+	}
+}
+
+func (d *dispatcher) writeOne(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	d.writeMu.Lock()
+	d.w.Write(data)
+	d.writeMu.Unlock()
+}
+
+// okReply builds a successful reply with no payload, e.g. for a WRITE,
+// FLUSH or TRIM.
+func okReply(handle uint64, structured bool) []byte {
+	if structured {
+		return buildStructuredDone(handle)
+	}
+	return buildSimpleReply(handle, 0, nil)
+}
+
+// errReply builds a failing reply. errno reaches every client; message
+// reaches only structured clients, since the legacy simple reply has no
+// room for one.
+func errReply(handle uint64, structured bool, errno uint32, message string) []byte {
+	if structured {
+		return buildStructuredError(handle, errno, message)
+	}
+	return buildSimpleReply(handle, errno, nil)
+}
+
+// processRequest runs a single request against its Device and encodes the
+// reply, in whichever format the connection negotiated.
+func processRequest(j job, structured bool, metaContextID uint32) []byte {
+	x := j.req
+	fua := x.typus&NBD_CMD_FLAG_FUA != 0
+
+	switch x.typus & NBD_CMD_MASK_COMMAND {
+	case NBD_CMD_READ:
+		data := make([]byte, x.len)
+		n, err := j.device.ReadAt(data, int64(x.from))
+		switch {
+		case err != nil:
+			return errReply(x.handle, structured, 1, err.Error())
+		case !structured:
+			return buildSimpleReply(x.handle, 0, data)
+		default:
+			var extents []Extent
+			if bs, ok := j.device.(BlockStatuser); ok {
+				extents, _ = bs.BlockStatus(int64(x.from), int64(n))
+			}
+			return buildStructuredRead(x.handle, int64(x.from), data[:n], extents)
+		}
+
+	case NBD_CMD_WRITE:
+		var err error
+		if fw, ok := j.device.(FUAWriter); ok {
+			_, err = fw.WriteAtFUA(j.writeData, int64(x.from), fua)
+		} else {
+			_, err = j.device.WriteAt(j.writeData, int64(x.from))
+		}
+		if err != nil {
+			return errReply(x.handle, structured, 1, err.Error())
+		}
+		return okReply(x.handle, structured)
+
+	case NBD_CMD_WRITE_ZEROES:
+		noHole := x.typus&NBD_CMD_FLAG_NO_HOLE != 0
+		var err error
+		if zw, ok := j.device.(ZeroWriter); ok {
+			err = zw.ZeroAt(int64(x.from), int64(x.len), noHole)
+		} else {
+			// Always writes real zero bytes rather than punching a hole,
+			// so NO_HOLE is trivially honored here.
+			_, err = j.device.WriteAt(make([]byte, x.len), int64(x.from))
+		}
+		if err != nil {
+			return errReply(x.handle, structured, 1, err.Error())
+		}
+		return okReply(x.handle, structured)
+
+	case NBD_CMD_FLUSH:
+		fl, ok := j.device.(Flusher)
+		if !ok {
+			return errReply(x.handle, structured, 1, "flush not supported")
+		}
+		if err := fl.Flush(); err != nil {
+			return errReply(x.handle, structured, 1, err.Error())
+		}
+		return okReply(x.handle, structured)
+
+	case NBD_CMD_TRIM:
+		tr, ok := j.device.(Trimmer)
+		if !ok {
+			return errReply(x.handle, structured, 1, "trim not supported")
+		}
+		if err := tr.TrimAt(int64(x.from), int64(x.len)); err != nil {
+			return errReply(x.handle, structured, 1, err.Error())
+		}
+		return okReply(x.handle, structured)
+
+	case NBD_CMD_BLOCK_STATUS:
+		if !structured {
+			return errReply(x.handle, structured, 1, "block status requires structured replies")
+		}
+		if metaContextID == 0 {
+			return errReply(x.handle, structured, 1, "no metadata context negotiated; send NBD_OPT_SET_META_CONTEXT first")
+		}
+		// A Device that doesn't implement BlockStatuser has no sparse
+		// regions to report, so it reads back as a single fully
+		// allocated, non-zero extent, per BlockStatuser's doc comment.
+		extents := []Extent{{Length: x.len, Flags: 0}}
+		if bs, ok := j.device.(BlockStatuser); ok {
+			var err error
+			extents, err = bs.BlockStatus(int64(x.from), int64(x.len))
+			if err != nil {
+				return errReply(x.handle, structured, 1, err.Error())
+			}
+		}
+		return buildStructuredBlockStatus(x.handle, metaContextID, extents)
+
+	default:
+		return errReply(x.handle, structured, 1, fmt.Sprintf("unknown command %d", x.typus&NBD_CMD_MASK_COMMAND))
+	}
+}
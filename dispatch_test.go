@@ -0,0 +1,317 @@
+// This file is part of fs1up.
+// Copyright (C) 2014 Andreas Klauer <Andreas.Klauer@metamorpher.de>
+// License: GPL-2
+
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+)
+
+// benchDevice is an in-memory Device sized for benchmarking: ReadAt and
+// WriteAt just copy bytes under a mutex, so the benchmark measures
+// dispatcher overhead rather than storage.
+type benchDevice struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func newBenchDevice(size int) *benchDevice {
+	return &benchDevice{data: make([]byte, size)}
+}
+
+func (d *benchDevice) ReadAt(b []byte, off int64) (int, error) {
+	d.mu.Lock()
+	n := copy(b, d.data[off:])
+	d.mu.Unlock()
+	return n, nil
+}
+
+func (d *benchDevice) WriteAt(b []byte, off int64) (int, error) {
+	d.mu.Lock()
+	n := copy(d.data[off:], b)
+	d.mu.Unlock()
+	return n, nil
+}
+
+// benchmarkMixedDispatch pushes queueDepth alternating read/write requests
+// through a dispatcher configured with workers goroutines, and measures
+// how long it takes to drain all of them.
+func benchmarkMixedDispatch(b *testing.B, workers, queueDepth int) {
+	dev := newBenchDevice(1 << 20)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	go io.Copy(io.Discard, r)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		disp := newDispatcher(w, false, 0, ServerOptions{Workers: workers})
+		for q := 0; q < queueDepth; q++ {
+			if q%2 == 0 {
+				disp.submit(job{
+					seq:    uint64(q),
+					req:    request{typus: NBD_CMD_READ, handle: uint64(q), from: 0, len: 4096},
+					device: dev,
+				})
+			} else {
+				disp.submit(job{
+					seq:       uint64(q),
+					req:       request{typus: NBD_CMD_WRITE, handle: uint64(q), from: 0},
+					writeData: make([]byte, 4096),
+					device:    dev,
+				})
+			}
+		}
+		disp.close()
+	}
+}
+
+// BenchmarkDispatchQueueDepth16 compares a single worker (effectively the
+// old serial handle() loop) against a small pool, at a queue depth typical
+// of a busy client.
+func BenchmarkDispatchQueueDepth16(b *testing.B) {
+	b.Run("workers=1", func(b *testing.B) { benchmarkMixedDispatch(b, 1, 16) })
+	b.Run("workers=8", func(b *testing.B) { benchmarkMixedDispatch(b, 8, 16) })
+}
+
+// BenchmarkDispatchQueueDepth256 repeats the comparison at a much deeper
+// queue, where the single-worker case pays for every ReadAt/WriteAt
+// serially.
+func BenchmarkDispatchQueueDepth256(b *testing.B) {
+	b.Run("workers=1", func(b *testing.B) { benchmarkMixedDispatch(b, 1, 256) })
+	b.Run("workers=8", func(b *testing.B) { benchmarkMixedDispatch(b, 8, 256) })
+}
+
+// TestWriteLoopOrder feeds writeLoop completions in the reverse of their
+// sequence order, as workers racing to finish ahead of the request they
+// were dispatched for would produce, and checks that it restores
+// submission order by default, and leaves completion order alone when
+// ServerOptions.OutOfOrder is set. Driving d.done directly, rather than
+// going through real workers, makes the completion order exact instead of
+// a timing-dependent approximation of it.
+func TestWriteLoopOrder(t *testing.T) {
+	t.Run("in-order by default", func(t *testing.T) {
+		testWriteLoopOrder(t, false, []uint64{0, 1, 2, 3})
+	})
+
+	t.Run("completion order with OutOfOrder", func(t *testing.T) {
+		testWriteLoopOrder(t, true, []uint64{3, 2, 1, 0})
+	})
+}
+
+func testWriteLoopOrder(t *testing.T, outOfOrder bool, want []uint64) {
+	r, w := io.Pipe()
+	defer r.Close()
+
+	d := &dispatcher{w: w, opts: ServerOptions{OutOfOrder: outOfOrder}, done: make(chan result)}
+	go d.writeLoop()
+
+	go func() {
+		for seq := len(want) - 1; seq >= 0; seq-- {
+			d.done <- result{seq: uint64(seq), data: buildSimpleReply(uint64(seq), 0, nil)}
+		}
+		close(d.done)
+	}()
+
+	header := make([]byte, 16) // buildSimpleReply's magic+errno+handle, with no data
+	got := make([]uint64, 0, len(want))
+	for range want {
+		if _, err := io.ReadFull(r, header); err != nil {
+			t.Fatalf("reading reply %d: %v", len(got), err)
+		}
+		got = append(got, binary.BigEndian.Uint64(header[8:16]))
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("reply order = %v, want %v", got, want)
+		}
+	}
+}
+
+// capDevice is a Device that records which of the optional capability
+// interfaces (Flusher, Trimmer, ZeroWriter, FUAWriter) processRequest
+// called, and with what arguments, without implementing any of them
+// unless the corresponding has* field is set.
+type capDevice struct {
+	hasFlusher    bool
+	hasTrimmer    bool
+	hasZeroWriter bool
+	hasFUAWriter  bool
+
+	flushed    bool
+	trimmedAt  int64
+	trimmedLen int64
+	zeroedAt   int64
+	zeroedLen  int64
+	zeroedHole bool
+	fuaWrote   bool
+	writeAtFUA bool
+
+	err error
+}
+
+func (d *capDevice) ReadAt(b []byte, off int64) (int, error)  { return len(b), nil }
+func (d *capDevice) WriteAt(b []byte, off int64) (int, error) { return len(b), d.err }
+
+type capFlusher struct{ *capDevice }
+
+func (d capFlusher) Flush() error { d.flushed = true; return d.err }
+
+type capTrimmer struct{ *capDevice }
+
+func (d capTrimmer) TrimAt(off, length int64) error {
+	d.trimmedAt, d.trimmedLen = off, length
+	return d.err
+}
+
+type capZeroWriter struct{ *capDevice }
+
+func (d capZeroWriter) ZeroAt(off, length int64, noHole bool) error {
+	d.zeroedAt, d.zeroedLen, d.zeroedHole = off, length, noHole
+	return d.err
+}
+
+type capFUAWriter struct{ *capDevice }
+
+func (d capFUAWriter) WriteAtFUA(b []byte, off int64, fua bool) (int, error) {
+	d.fuaWrote, d.writeAtFUA = true, fua
+	return len(b), d.err
+}
+
+// device wraps c in whichever capability interfaces its has* fields
+// request, the way a real Device implementation would implement only
+// the operations it actually supports.
+func (c *capDevice) device() Device {
+	switch {
+	case c.hasFlusher:
+		return struct {
+			Device
+			Flusher
+		}{c, capFlusher{c}}
+	case c.hasTrimmer:
+		return struct {
+			Device
+			Trimmer
+		}{c, capTrimmer{c}}
+	case c.hasZeroWriter:
+		return struct {
+			Device
+			ZeroWriter
+		}{c, capZeroWriter{c}}
+	case c.hasFUAWriter:
+		return struct {
+			Device
+			FUAWriter
+		}{c, capFUAWriter{c}}
+	default:
+		return c
+	}
+}
+
+func TestProcessRequestFlush(t *testing.T) {
+	t.Run("calls Flush when implemented", func(t *testing.T) {
+		c := &capDevice{hasFlusher: true}
+		reply := processRequest(job{req: request{typus: NBD_CMD_FLUSH, handle: 1}, device: c.device()}, false, 0)
+		if !c.flushed {
+			t.Error("Flush was not called")
+		}
+		if errno := binary.BigEndian.Uint32(reply[4:8]); errno != 0 {
+			t.Errorf("errno = %d, want 0", errno)
+		}
+	})
+
+	t.Run("fails without Flusher", func(t *testing.T) {
+		c := &capDevice{}
+		reply := processRequest(job{req: request{typus: NBD_CMD_FLUSH, handle: 1}, device: c.device()}, false, 0)
+		if errno := binary.BigEndian.Uint32(reply[4:8]); errno == 0 {
+			t.Error("errno = 0, want a failure for a Device without Flusher")
+		}
+	})
+}
+
+func TestProcessRequestTrim(t *testing.T) {
+	t.Run("calls TrimAt when implemented", func(t *testing.T) {
+		c := &capDevice{hasTrimmer: true}
+		reply := processRequest(job{req: request{typus: NBD_CMD_TRIM, handle: 1, from: 4096, len: 8192}, device: c.device()}, false, 0)
+		if c.trimmedAt != 4096 || c.trimmedLen != 8192 {
+			t.Errorf("TrimAt(%d, %d), want (4096, 8192)", c.trimmedAt, c.trimmedLen)
+		}
+		if errno := binary.BigEndian.Uint32(reply[4:8]); errno != 0 {
+			t.Errorf("errno = %d, want 0", errno)
+		}
+	})
+
+	t.Run("fails without Trimmer", func(t *testing.T) {
+		c := &capDevice{}
+		reply := processRequest(job{req: request{typus: NBD_CMD_TRIM, handle: 1}, device: c.device()}, false, 0)
+		if errno := binary.BigEndian.Uint32(reply[4:8]); errno == 0 {
+			t.Error("errno = 0, want a failure for a Device without Trimmer")
+		}
+	})
+}
+
+func TestProcessRequestWriteZeroes(t *testing.T) {
+	t.Run("passes NO_HOLE through to ZeroWriter", func(t *testing.T) {
+		c := &capDevice{hasZeroWriter: true}
+		req := request{typus: NBD_CMD_WRITE_ZEROES | NBD_CMD_FLAG_NO_HOLE, handle: 1, from: 100, len: 200}
+		reply := processRequest(job{req: req, device: c.device()}, false, 0)
+		if c.zeroedAt != 100 || c.zeroedLen != 200 || !c.zeroedHole {
+			t.Errorf("ZeroAt(%d, %d, %v), want (100, 200, true)", c.zeroedAt, c.zeroedLen, c.zeroedHole)
+		}
+		if errno := binary.BigEndian.Uint32(reply[4:8]); errno != 0 {
+			t.Errorf("errno = %d, want 0", errno)
+		}
+	})
+
+	t.Run("falls back to a zero-filled WriteAt without ZeroWriter", func(t *testing.T) {
+		c := &capDevice{}
+		req := request{typus: NBD_CMD_WRITE_ZEROES, handle: 1, from: 0, len: 16}
+		reply := processRequest(job{req: req, device: c}, false, 0)
+		if errno := binary.BigEndian.Uint32(reply[4:8]); errno != 0 {
+			t.Errorf("errno = %d, want 0", errno)
+		}
+	})
+}
+
+func TestProcessRequestWriteFUA(t *testing.T) {
+	t.Run("passes FUA through to FUAWriter", func(t *testing.T) {
+		c := &capDevice{hasFUAWriter: true}
+		req := request{typus: NBD_CMD_WRITE | NBD_CMD_FLAG_FUA, handle: 1, from: 0, len: 4}
+		reply := processRequest(job{req: req, writeData: make([]byte, 4), device: c.device()}, false, 0)
+		if !c.fuaWrote || !c.writeAtFUA {
+			t.Errorf("WriteAtFUA called = %v, fua = %v, want true, true", c.fuaWrote, c.writeAtFUA)
+		}
+		if errno := binary.BigEndian.Uint32(reply[4:8]); errno != 0 {
+			t.Errorf("errno = %d, want 0", errno)
+		}
+	})
+
+	t.Run("falls back to WriteAt without FUAWriter", func(t *testing.T) {
+		c := &capDevice{}
+		req := request{typus: NBD_CMD_WRITE, handle: 1, from: 0, len: 4}
+		reply := processRequest(job{req: req, writeData: make([]byte, 4), device: c}, false, 0)
+		if errno := binary.BigEndian.Uint32(reply[4:8]); errno != 0 {
+			t.Errorf("errno = %d, want 0", errno)
+		}
+	})
+}
+
+func TestProcessRequestErrorPropagation(t *testing.T) {
+	c := &capDevice{hasFlusher: true, err: errors.New("disk on fire")}
+	reply := processRequest(job{req: request{typus: NBD_CMD_FLUSH, handle: 1}, device: c.device()}, false, 0)
+	if errno := binary.BigEndian.Uint32(reply[4:8]); errno == 0 {
+		t.Error("errno = 0, want a failure propagated from Flush")
+	}
+}
@@ -6,8 +6,10 @@
 package nbd
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
 	"syscall"
@@ -29,17 +31,24 @@ const (
 	NBD_SET_TIMEOUT     = 43785
 	NBD_SET_FLAGS       = 43786
 	// enum
-	NBD_CMD_READ  = 0
-	NBD_CMD_WRITE = 1
-	NBD_CMD_DISC  = 2
-	NBD_CMD_FLUSH = 3
-	NBD_CMD_TRIM  = 4
+	NBD_CMD_READ         = 0
+	NBD_CMD_WRITE        = 1
+	NBD_CMD_DISC         = 2
+	NBD_CMD_FLUSH        = 3
+	NBD_CMD_TRIM         = 4
+	NBD_CMD_WRITE_ZEROES = 6
+	// the command occupies the low 16 bits of typus; the high 16 bits
+	// are per-command flags
+	NBD_CMD_MASK_COMMAND = 0x0000ffff
+	NBD_CMD_FLAG_FUA     = 1 << 16 // persist this write before replying
+	NBD_CMD_FLAG_NO_HOLE = 1 << 17 // NBD_CMD_WRITE_ZEROES must not punch a hole
 	// values for flags field
-	NBD_FLAG_HAS_FLAGS  = (1 << 0) // nbd-server supports flags
-	NBD_FLAG_READ_ONLY  = (1 << 1) // device is read-only
-	NBD_FLAG_SEND_FLUSH = (1 << 2) // can flush writeback cache
-	// there is a gap here to match userspace
-	NBD_FLAG_SEND_TRIM = (1 << 5) // send trim/discard
+	NBD_FLAG_HAS_FLAGS         = (1 << 0) // nbd-server supports flags
+	NBD_FLAG_READ_ONLY         = (1 << 1) // device is read-only
+	NBD_FLAG_SEND_FLUSH        = (1 << 2) // can flush writeback cache
+	NBD_FLAG_SEND_FUA          = (1 << 3) // send FUA (Force Unit Access)
+	NBD_FLAG_SEND_TRIM         = (1 << 5) // send trim/discard
+	NBD_FLAG_SEND_WRITE_ZEROES = (1 << 6) // send write zeroes
 	// These are sent over the network in the request/reply magic fields
 	NBD_REQUEST_MAGIC = 0x25609513
 	NBD_REPLY_MAGIC   = 0x67446698
@@ -74,13 +83,68 @@ func ioctl(a1, a2, a3 uintptr) (err error) {
 	return err
 }
 
-func handle(fd int, d Device) {
-	buf := make([]byte, 2<<19)
-	var x request
+// disconnect asks the kernel to tear down nbd's transmission socket,
+// unblocking a concurrent ioctl(NBD_DO_IT). It is a no-op if nbd is nil
+// (there is no kernel device to tell, e.g. when serving a TCP client),
+// and deliberately ignores errors: by the time it's called the device may
+// already be disconnected, which is fine.
+func disconnect(nbd *os.File) {
+	if nbd == nil {
+		return
+	}
+	ioctl(nbd.Fd(), NBD_DISCONNECT, 0)
+	ioctl(nbd.Fd(), NBD_CLEAR_SOCK, 0)
+}
+
+// handle runs the transmission-phase request/reply loop against sock. This
+// goroutine only parses requests and, for NBD_CMD_WRITE, drains their
+// payload; every parsed request is handed to a dispatcher, which runs it
+// against d on a pool of worker goroutines (sized by opts) and serializes
+// replies back onto sock, so a slow ReadAt/WriteAt no longer blocks
+// parsing of the next request. When structured is true
+// (NBD_OPT_STRUCTURED_REPLY was negotiated during the newstyle
+// handshake), replies are encoded as structured reply chunks; otherwise
+// the legacy simple reply is used, as required by the kernel ioctl
+// client.
+//
+// nbd, if non-nil, is the kernel-attached /dev/nbdN device that sock is
+// the transmission socket for; handle disconnects it once the loop ends,
+// for any reason, so a broken connection can't leave a concurrent
+// ioctl(NBD_DO_IT) blocked forever. ctx lets the caller request a clean
+// shutdown; cancelling it closes sock, which unblocks the read below.
+//
+// metaContextID is the metadata context id NBD_CMD_BLOCK_STATUS replies
+// should be tagged with, as negotiated via NBD_OPT_SET_META_CONTEXT
+// during the newstyle handshake; it is 0 (meaning none negotiated) on
+// the kernel ioctl path, which has no such handshake.
+func handle(ctx context.Context, sock *os.File, nbd *os.File, d Device, structured bool, metaContextID uint32, opts ServerOptions) (err error) {
+	defer disconnect(nbd)
+	defer sock.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sock.Close()
+		case <-stop:
+		}
+	}()
+
+	buf := make([]byte, 28) // just the request header; payloads get their own buffers
+	disp := newDispatcher(sock, structured, metaContextID, opts)
+	var seq uint64
 
 	for {
-		syscall.Read(fd, buf[0:28])
+		if _, err := io.ReadFull(sock, buf[0:28]); err != nil {
+			disp.close()
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("nbd: reading request header: %w", err)
+		}
 
+		var x request
 		x.magic = binary.BigEndian.Uint32(buf)
 		x.typus = binary.BigEndian.Uint32(buf[4:8])
 		x.handle = binary.BigEndian.Uint64(buf[8:16])
@@ -91,40 +155,49 @@ func handle(fd int, d Device) {
 		case NBD_REPLY_MAGIC:
 			fallthrough
 		case NBD_REQUEST_MAGIC:
-			switch x.typus {
-			case NBD_CMD_READ:
-				d.ReadAt(buf[16:16+x.len], int64(x.from))
-				binary.BigEndian.PutUint32(buf[0:4], NBD_REPLY_MAGIC)
-				binary.BigEndian.PutUint32(buf[4:8], 0)
-				syscall.Write(fd, buf[0:16+x.len])
+			switch x.typus & NBD_CMD_MASK_COMMAND {
+			case NBD_CMD_DISC:
+				disp.close()
+				return nil
 			case NBD_CMD_WRITE:
-				n, _ := syscall.Read(fd, buf[28:28+x.len])
-				for uint32(n) < x.len {
-					m, _ := syscall.Read(fd, buf[28+n:28+x.len])
-					n += m
+				if x.len > opts.maxRequestSize() {
+					disp.close()
+					return fmt.Errorf("nbd: write request of %d bytes exceeds limit", x.len)
 				}
-				d.WriteAt(buf[28:28+x.len], int64(x.from))
-				binary.BigEndian.PutUint32(buf[0:4], NBD_REPLY_MAGIC)
-				binary.BigEndian.PutUint32(buf[4:8], 0)
-				syscall.Write(fd, buf[0:16])
-			case NBD_CMD_DISC:
-				panic("Disconnect")
-			case NBD_CMD_FLUSH:
-				fallthrough
-			case NBD_CMD_TRIM:
-				binary.BigEndian.PutUint32(buf[0:4], NBD_REPLY_MAGIC)
-				binary.BigEndian.PutUint32(buf[4:8], 1)
-				syscall.Write(fd, buf[0:16])
+				data := make([]byte, x.len)
+				if _, err := io.ReadFull(sock, data); err != nil {
+					disp.close()
+					return fmt.Errorf("nbd: reading write payload: %w", err)
+				}
+				disp.submit(job{seq: seq, req: x, writeData: data, device: d})
+			case NBD_CMD_READ:
+				if x.len > opts.maxRequestSize() {
+					disp.close()
+					return fmt.Errorf("nbd: read request of %d bytes exceeds limit", x.len)
+				}
+				disp.submit(job{seq: seq, req: x, device: d})
+			case NBD_CMD_WRITE_ZEROES:
+				if x.len > opts.maxRequestSize() {
+					disp.close()
+					return fmt.Errorf("nbd: write-zeroes request of %d bytes exceeds limit", x.len)
+				}
+				disp.submit(job{seq: seq, req: x, device: d})
 			default:
-				panic("unknown command")
+				disp.submit(job{seq: seq, req: x, device: d})
 			}
+			seq++
 		default:
-			panic("Invalid packet")
+			disp.close()
+			return fmt.Errorf("nbd: invalid request magic %#x", x.magic)
 		}
 	}
 }
 
-func Client(d Device, offset int64, size int64) (err error) {
+// Client attaches d to the first free /dev/nbdN device, using the legacy
+// ioctl interface, and blocks until it is detached or ctx is cancelled.
+// opts configures the worker pool that serves requests once the device is
+// attached; the zero value picks sane defaults.
+func Client(ctx context.Context, d Device, offset int64, size int64, opts ServerOptions) (err error) {
 	var (
 		nbd *os.File
 	)
@@ -134,9 +207,11 @@ func Client(d Device, offset int64, size int64) (err error) {
 		return err
 	}
 
-	go handle(fd[1], d)
+	sock := os.NewFile(uintptr(fd[1]), "nbd-socketpair")
+	errc := make(chan error, 1)
 
 	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
 
 	// find free nbd device
 	for i := 0; ; i++ {
@@ -144,6 +219,7 @@ func Client(d Device, offset int64, size int64) (err error) {
 
 		if err != nil {
 			// assume no more devices exist
+			sock.Close()
 			return err
 		}
 
@@ -155,22 +231,40 @@ func Client(d Device, offset int64, size int64) (err error) {
 		}
 	}
 
+	go func() { errc <- handle(ctx, sock, nbd, d, false, 0, opts) }()
+
+	didDoIt := false
+
 	if err = ioctl(nbd.Fd(), NBD_SET_BLKSIZE, 4096); err != nil {
 		err = &os.PathError{nbd.Name(), "ioctl NBD_SET_BLKSIZE", err}
 	} else if err = ioctl(nbd.Fd(), NBD_SET_SIZE_BLOCKS, uintptr(size/4096)); err != nil {
 		err = &os.PathError{nbd.Name(), "ioctl NBD_SET_SIZE_BLOCKS", err}
-	} else if err = ioctl(nbd.Fd(), NBD_SET_FLAGS, 1); err != nil {
+	} else if err = ioctl(nbd.Fd(), NBD_SET_FLAGS, uintptr(deviceFlags(d))); err != nil {
 		err = &os.PathError{nbd.Name(), "ioctl NBD_SET_FLAGS", err}
 	} else if err = ioctl(nbd.Fd(), BLKROSET, 0); err != nil {
 		err = &os.PathError{nbd.Name(), "ioctl BLKROSET", err}
-	} else if err = ioctl(nbd.Fd(), NBD_DO_IT, 0); err != nil {
-		err = &os.PathError{nbd.Name(), "ioctl NBD_DO_IT", err}
-	} else if err = ioctl(nbd.Fd(), NBD_DISCONNECT, 0); err != nil {
-		err = &os.PathError{nbd.Name(), "ioctl NBD_DISCONNECT", err}
-	} else if err = ioctl(nbd.Fd(), NBD_CLEAR_SOCK, 0); err != nil {
-		err = &os.PathError{nbd.Name(), "ioctl NBD_CLEAR_SOCK", err}
+	} else {
+		didDoIt = true
+		if err = ioctl(nbd.Fd(), NBD_DO_IT, 0); err != nil {
+			err = &os.PathError{nbd.Name(), "ioctl NBD_DO_IT", err}
+		}
+	}
+
+	if !didDoIt {
+		// One of the setup ioctls failed before NBD_DO_IT was issued, so
+		// the kernel will never drive fd[0] and handle()'s goroutine is
+		// stuck in io.ReadFull(sock, ...) with nothing to unblock it.
+		// Close sock ourselves so it returns, instead of waiting on errc
+		// forever.
+		sock.Close()
+	}
+
+	// NBD_DO_IT only returns once the device is disconnected; handle()
+	// disconnects it itself on any error or clean NBD_CMD_DISC, so by now
+	// it has finished (or is about to).
+	if hErr := <-errc; hErr != nil && err == nil {
+		err = hErr
 	}
 
-	runtime.UnlockOSThread()
 	return err
 }
@@ -0,0 +1,177 @@
+// This file is part of fs1up.
+// Copyright (C) 2014 Andreas Klauer <Andreas.Klauer@metamorpher.de>
+// License: GPL-2
+
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"syscall"
+	"testing"
+)
+
+func TestAppendParseAttrs(t *testing.T) {
+	var buf []byte
+	buf = appendU32Attr(buf, 1, 0xdeadbeef)
+	buf = appendU64Attr(buf, 2, 0x1122334455667788)
+	buf = appendStringAttr(buf, 3, "nbd")
+
+	var nested []byte
+	nested = appendU32Attr(nested, 9, 7)
+	buf = appendNestedAttr(buf, 4, nested)
+
+	attrs := parseAttrs(buf)
+
+	if v, ok := attrs[1]; !ok || binary.LittleEndian.Uint32(v) != 0xdeadbeef {
+		t.Errorf("attr 1 = %v, want uint32 0xdeadbeef", v)
+	}
+	if v, ok := attrs[2]; !ok || binary.LittleEndian.Uint64(v) != 0x1122334455667788 {
+		t.Errorf("attr 2 = %v, want uint64 0x1122334455667788", v)
+	}
+	if v, ok := attrs[3]; !ok || string(v) != "nbd\x00" {
+		t.Errorf("attr 3 = %q, want %q", v, "nbd\x00")
+	}
+	// appendNestedAttr ORs in nlaFNested, which parseAttrs must mask off
+	// to recover the original type.
+	v, ok := attrs[4]
+	if !ok {
+		t.Fatalf("attr 4 missing, have %v", attrs)
+	}
+	inner := parseAttrs(v)
+	if iv, ok := inner[9]; !ok || binary.LittleEndian.Uint32(iv) != 7 {
+		t.Errorf("nested attr 9 = %v, want uint32 7", iv)
+	}
+}
+
+func TestAppendAttrPadding(t *testing.T) {
+	// A single 1-byte attribute must come out padded to a 4-byte
+	// boundary, the way the kernel expects attributes packed back to
+	// back.
+	buf := appendAttr(nil, 1, []byte{0x42})
+	if len(buf)%4 != 0 {
+		t.Fatalf("len(buf) = %d, not 4-byte aligned", len(buf))
+	}
+	if got := len(buf); got != 8 {
+		t.Errorf("len(buf) = %d, want 8 (4-byte header + 1 byte padded to 4)", got)
+	}
+}
+
+func TestParseNestedList(t *testing.T) {
+	var list []byte
+	for i, idx := range []uint32{0, 1, 2} {
+		var item []byte
+		item = appendU32Attr(item, nbdDeviceItemIndex, idx)
+		item = appendAttr(item, nbdDeviceItemConnected, []byte{byte(i % 2)})
+		list = appendNestedAttr(list, 0, item)
+	}
+	// appendNestedAttr wraps list itself; parseNestedList expects the
+	// unwrapped body, same as what parseAttrs hands back for an
+	// NBD_ATTR_DEVICE_LIST entry.
+	raw := parseAttrs(appendNestedAttr(nil, 9, list))[9]
+
+	items := parseNestedList(raw)
+	if len(items) != 3 {
+		t.Fatalf("got %d items, want 3", len(items))
+	}
+	for i, item := range items {
+		if v := binary.LittleEndian.Uint32(item[nbdDeviceItemIndex]); v != uint32(i) {
+			t.Errorf("item %d index = %d, want %d", i, v, i)
+		}
+		wantConnected := byte(i % 2)
+		if v := item[nbdDeviceItemConnected][0]; v != wantConnected {
+			t.Errorf("item %d connected = %d, want %d", i, v, wantConnected)
+		}
+	}
+}
+
+// buildNlmsg constructs one raw netlink message: header, generic netlink
+// header (cmd + version), and attrs, the wire format recvMessages parses.
+func buildNlmsg(typ uint16, seq uint32, cmd uint8, attrs []byte) []byte {
+	total := nlmsgHdrLen + genlHdrLen + len(attrs)
+	buf := make([]byte, nlmsgHdrLen+genlHdrLen, total)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(total))
+	binary.LittleEndian.PutUint16(buf[4:6], typ)
+	binary.LittleEndian.PutUint32(buf[8:12], seq)
+	buf[16] = cmd
+	buf[17] = 1
+	return append(buf, attrs...)
+}
+
+// buildNlmsgErr constructs a bare NLMSG_ERROR ack/nak for seq.
+func buildNlmsgErr(seq uint32, errno int32) []byte {
+	payload := make([]byte, 4)
+	binary.LittleEndian.PutUint32(payload, uint32(errno))
+	buf := make([]byte, nlmsgHdrLen, nlmsgHdrLen+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(nlmsgHdrLen+len(payload)))
+	binary.LittleEndian.PutUint16(buf[4:6], nlmsgError)
+	binary.LittleEndian.PutUint32(buf[8:12], seq)
+	return append(buf, payload...)
+}
+
+func TestParseNlmsgs(t *testing.T) {
+	t.Run("genl reply with matching seq is returned", func(t *testing.T) {
+		attrs := appendU32Attr(nil, nbdAttrIndex, 3)
+		buf := buildNlmsg(genlIDCtrl, 2, nbdCmdConnect, attrs)
+
+		msgs, err := parseNlmsgs(buf, 2)
+		if err != nil {
+			t.Fatalf("parseNlmsgs: %v", err)
+		}
+		if len(msgs) != 1 {
+			t.Fatalf("got %d msgs, want 1", len(msgs))
+		}
+		if v := binary.LittleEndian.Uint32(msgs[0][nbdAttrIndex]); v != 3 {
+			t.Errorf("index = %d, want 3", v)
+		}
+	})
+
+	t.Run("mismatched seq is ignored", func(t *testing.T) {
+		attrs := appendU32Attr(nil, nbdAttrIndex, 3)
+		buf := buildNlmsg(genlIDCtrl, 99, nbdCmdConnect, attrs)
+
+		msgs, err := parseNlmsgs(buf, 2)
+		if err != nil {
+			t.Fatalf("parseNlmsgs: %v", err)
+		}
+		if len(msgs) != 0 {
+			t.Fatalf("got %d msgs, want 0", len(msgs))
+		}
+	})
+
+	t.Run("zero-errno ack contributes no message and no error", func(t *testing.T) {
+		buf := buildNlmsgErr(2, 0)
+
+		msgs, err := parseNlmsgs(buf, 2)
+		if err != nil {
+			t.Fatalf("parseNlmsgs: %v", err)
+		}
+		if len(msgs) != 0 {
+			t.Fatalf("got %d msgs, want 0", len(msgs))
+		}
+	})
+
+	t.Run("non-zero-errno nak fails the call", func(t *testing.T) {
+		buf := buildNlmsgErr(2, -int32(syscall.ENOENT))
+
+		_, err := parseNlmsgs(buf, 2)
+		if !bytes.Contains([]byte(err.Error()), []byte(syscall.ENOENT.Error())) {
+			t.Fatalf("err = %v, want it to wrap %v", err, syscall.ENOENT)
+		}
+	})
+
+	t.Run("reply followed by a trailing ack for the same seq", func(t *testing.T) {
+		attrs := appendU32Attr(nil, nbdAttrIndex, 3)
+		reply := buildNlmsg(genlIDCtrl, 2, nbdCmdConnect, attrs)
+		ack := buildNlmsgErr(2, 0)
+		buf := append(reply, ack...)
+
+		msgs, err := parseNlmsgs(buf, 2)
+		if err != nil {
+			t.Fatalf("parseNlmsgs: %v", err)
+		}
+		if len(msgs) != 1 {
+			t.Fatalf("got %d msgs, want 1", len(msgs))
+		}
+	})
+}
@@ -0,0 +1,42 @@
+// This file is part of fs1up.
+// Copyright (C) 2014 Andreas Klauer <Andreas.Klauer@metamorpher.de>
+// License: GPL-2
+
+package nbd
+
+import "runtime"
+
+// ServerOptions configures how the transmission-phase request/reply loop
+// in handle() dispatches work. The zero value is a sane default: one
+// worker per CPU, defaultMaxRequestSize as the cap on request size, and
+// replies delivered to the client in the same order their requests arrived.
+type ServerOptions struct {
+	// Workers is the number of goroutines used to process in-flight
+	// requests concurrently. Zero means runtime.NumCPU().
+	Workers int
+
+	// MaxRequestSize caps the length of a single NBD_CMD_READ,
+	// NBD_CMD_WRITE or NBD_CMD_WRITE_ZEROES request. Zero means
+	// defaultMaxRequestSize.
+	MaxRequestSize uint32
+
+	// OutOfOrder allows replies to reach the client in whatever order
+	// their workers finish, instead of the order requests arrived in.
+	// The NBD protocol allows this (replies carry the request's handle),
+	// but some older clients assume in-order delivery.
+	OutOfOrder bool
+}
+
+func (o ServerOptions) workers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+	return runtime.NumCPU()
+}
+
+func (o ServerOptions) maxRequestSize() uint32 {
+	if o.MaxRequestSize > 0 {
+		return o.MaxRequestSize
+	}
+	return defaultMaxRequestSize
+}
@@ -0,0 +1,94 @@
+// This file is part of fs1up.
+// Copyright (C) 2014 Andreas Klauer <Andreas.Klauer@metamorpher.de>
+// License: GPL-2
+
+package nbd
+
+// Constants for the newstyle/fixed-newstyle negotiation used by network
+// NBD servers (as opposed to the legacy kernel ioctl interface in nbd.go).
+// See the protocol document at
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+const (
+	// NBDMAGIC and IHAVEOPT open the handshake.
+	nbdMagic = 0x4e42444d41474943 // "NBDMAGIC"
+	ihaveopt = 0x49484156454f5054 // "IHAVEOPT"
+
+	// optMagic tags every option reply from the server.
+	optMagic = 0x3e889045565a9
+
+	// Handshake flags, sent by the server after NBDMAGIC+IHAVEOPT.
+	NBD_FLAG_FIXED_NEWSTYLE = 1 << 0
+	NBD_FLAG_NO_ZEROES      = 1 << 1
+
+	// Client flags, sent by the client in response to the handshake flags.
+	NBD_FLAG_C_FIXED_NEWSTYLE = 1 << 0
+	NBD_FLAG_C_NO_ZEROES      = 1 << 1
+
+	// maxOptionLength caps the data length a client may claim for a single
+	// option during haggling, before any of it is read. Without this, a
+	// client could send a 16-byte option header claiming a 4GiB length
+	// and make the (pre-authentication) server allocate 4GiB per
+	// connection. Real options (export names, NBD_OPT_INFO/GO requests)
+	// are a few dozen bytes at most, so this is generous headroom.
+	maxOptionLength = 64 * 1024
+
+	// Options, sent by the client during option haggling.
+	NBD_OPT_EXPORT_NAME      = 1
+	NBD_OPT_ABORT            = 2
+	NBD_OPT_LIST             = 3
+	NBD_OPT_STARTTLS         = 5
+	NBD_OPT_INFO             = 6
+	NBD_OPT_GO               = 7
+	NBD_OPT_STRUCTURED_REPLY = 8
+	NBD_OPT_SET_META_CONTEXT = 10
+
+	// Reply types, sent by the server in response to an option.
+	NBD_REP_ACK          = 1
+	NBD_REP_SERVER       = 2
+	NBD_REP_INFO         = 3
+	NBD_REP_META_CONTEXT = 4
+
+	// NBD_REP_FLAG_ERROR is or'd into a reply type to signal failure.
+	NBD_REP_FLAG_ERROR  = 1 << 31
+	NBD_REP_ERR_UNSUP   = 1 | NBD_REP_FLAG_ERROR
+	NBD_REP_ERR_INVALID = 3 | NBD_REP_FLAG_ERROR
+	NBD_REP_ERR_UNKNOWN = 6 | NBD_REP_FLAG_ERROR
+
+	// Information types used in NBD_OPT_INFO/NBD_OPT_GO replies.
+	NBD_INFO_EXPORT = 0
+
+	// structuredReplyMagic tags every chunk of a structured reply, in
+	// place of NBD_REPLY_MAGIC, once NBD_OPT_STRUCTURED_REPLY has been
+	// negotiated.
+	structuredReplyMagic = 0x668e33ef
+
+	// NBD_REPLY_FLAG_DONE marks the final chunk of a structured reply.
+	NBD_REPLY_FLAG_DONE = 1 << 0
+
+	// Structured reply chunk types.
+	NBD_REPLY_TYPE_NONE         = 0
+	NBD_REPLY_TYPE_OFFSET_DATA  = 1
+	NBD_REPLY_TYPE_OFFSET_HOLE  = 2
+	NBD_REPLY_TYPE_BLOCK_STATUS = 5
+	NBD_REPLY_TYPE_ERROR        = 1<<15 + 1
+
+	// NBD_CMD_BLOCK_STATUS lets a client ask which parts of an export are
+	// holes or zeroed, answered from Extents reported by a BlockStatuser.
+	NBD_CMD_BLOCK_STATUS = 7
+
+	// Extent flags, as reported by BlockStatus.
+	NBD_STATE_HOLE = 1 << 0
+	NBD_STATE_ZERO = 1 << 1
+
+	// baseAllocationMetaContext is the only metadata context this
+	// package serves in response to NBD_OPT_SET_META_CONTEXT: it
+	// exposes BlockStatuser's Extents, the same thing nbdkit/qemu-nbd
+	// call "base:allocation".
+	baseAllocationMetaContext = "base:allocation"
+
+	// baseAllocationContextID is the id handed back to a client that
+	// negotiates baseAllocationMetaContext, and used to tag the
+	// NBD_REPLY_TYPE_BLOCK_STATUS chunks built for it. 0 is reserved to
+	// mean "no metadata context negotiated yet".
+	baseAllocationContextID = 1
+)
@@ -0,0 +1,158 @@
+// This file is part of fs1up.
+// Copyright (C) 2014 Andreas Klauer <Andreas.Klauer@metamorpher.de>
+// License: GPL-2
+
+package nbd
+
+import "encoding/binary"
+
+// These build reply wire formats as plain byte slices; handle() is
+// responsible for actually writing them to the connection, through the
+// single writer goroutine in dispatch.go that serializes concurrent
+// workers' replies onto the socket.
+
+// buildSimpleReply builds the legacy 16-byte-header reply used by clients
+// that did not negotiate NBD_OPT_STRUCTURED_REPLY.
+func buildSimpleReply(handle uint64, errno uint32, data []byte) []byte {
+	buf := make([]byte, 16+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], NBD_REPLY_MAGIC)
+	binary.BigEndian.PutUint32(buf[4:8], errno)
+	binary.BigEndian.PutUint64(buf[8:16], handle)
+	copy(buf[16:], data)
+	return buf
+}
+
+// buildStructuredChunk builds one structured reply chunk: the structured
+// reply magic, flags, chunk type, request handle, payload length and
+// payload.
+func buildStructuredChunk(handle uint64, flags uint16, typ uint16, payload []byte) []byte {
+	buf := make([]byte, 4+2+2+8+4+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], structuredReplyMagic)
+	binary.BigEndian.PutUint16(buf[4:6], flags)
+	binary.BigEndian.PutUint16(buf[6:8], typ)
+	binary.BigEndian.PutUint64(buf[8:16], handle)
+	binary.BigEndian.PutUint32(buf[16:20], uint32(len(payload)))
+	copy(buf[20:], payload)
+	return buf
+}
+
+// buildStructuredDone builds a zero-length NBD_REPLY_TYPE_NONE chunk
+// terminating a structured reply, used for commands (like WRITE) that
+// have no payload of their own.
+func buildStructuredDone(handle uint64) []byte {
+	return buildStructuredChunk(handle, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_NONE, nil)
+}
+
+// buildStructuredData builds a single NBD_REPLY_TYPE_OFFSET_DATA chunk
+// carrying data read from off. done marks it as the reply's final chunk;
+// a multi-chunk reply (see buildStructuredRead) sets it on only the last
+// one.
+func buildStructuredData(handle uint64, off int64, data []byte, done bool) []byte {
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(payload[0:8], uint64(off))
+	copy(payload[8:], data)
+	return buildStructuredChunk(handle, doneFlag(done), NBD_REPLY_TYPE_OFFSET_DATA, payload)
+}
+
+// buildStructuredHole builds a single NBD_REPLY_TYPE_OFFSET_HOLE chunk
+// describing a zero-filled range at off, with no data of its own on the
+// wire. done marks it as the reply's final chunk.
+func buildStructuredHole(handle uint64, off int64, length uint32, done bool) []byte {
+	payload := make([]byte, 8+4)
+	binary.BigEndian.PutUint64(payload[0:8], uint64(off))
+	binary.BigEndian.PutUint32(payload[8:12], length)
+	return buildStructuredChunk(handle, doneFlag(done), NBD_REPLY_TYPE_OFFSET_HOLE, payload)
+}
+
+func doneFlag(done bool) uint16 {
+	if done {
+		return NBD_REPLY_FLAG_DONE
+	}
+	return 0
+}
+
+// readSegment is one contiguous piece of a structured NBD_CMD_READ reply:
+// either a hole (answered with NBD_REPLY_TYPE_OFFSET_HOLE, no data on the
+// wire) or real data (answered with NBD_REPLY_TYPE_OFFSET_DATA).
+type readSegment struct {
+	off  int64
+	hole bool
+	data []byte // unused when hole is true
+}
+
+// planReadSegments splits a read of data (already fetched from off) into
+// readSegments, using extents to mark which parts of it BlockStatus
+// reported as holes. extents are trusted to be offset-ordered and
+// contiguous from off, without being checked; any range beyond
+// what they cover, or the whole read if extents is empty, falls back to a
+// plain data segment.
+func planReadSegments(off int64, data []byte, extents []Extent) []readSegment {
+	var segments []readSegment
+	pos := int64(0)
+	for _, e := range extents {
+		if pos >= int64(len(data)) {
+			break
+		}
+		length := int64(e.Length)
+		if pos+length > int64(len(data)) {
+			length = int64(len(data)) - pos
+		}
+		if length <= 0 {
+			continue
+		}
+		segments = append(segments, readSegment{off: off + pos, hole: e.Flags&NBD_STATE_HOLE != 0, data: data[pos : pos+length]})
+		pos += length
+	}
+	if pos < int64(len(data)) {
+		segments = append(segments, readSegment{off: off + pos, data: data[pos:]})
+	}
+	if len(segments) == 0 {
+		segments = append(segments, readSegment{off: off, data: data})
+	}
+	return segments
+}
+
+// buildStructuredRead builds the chunk sequence answering a structured
+// NBD_CMD_READ, emitting an NBD_REPLY_TYPE_OFFSET_HOLE chunk for each
+// range extents marks as a hole and an NBD_REPLY_TYPE_OFFSET_DATA chunk
+// for the rest, so a sparse export's reads don't need to ship zero bytes
+// over the wire.
+func buildStructuredRead(handle uint64, off int64, data []byte, extents []Extent) []byte {
+	segments := planReadSegments(off, data, extents)
+	var out []byte
+	for i, s := range segments {
+		done := i == len(segments)-1
+		if s.hole {
+			out = append(out, buildStructuredHole(handle, s.off, uint32(len(s.data)), done)...)
+		} else {
+			out = append(out, buildStructuredData(handle, s.off, s.data, done)...)
+		}
+	}
+	return out
+}
+
+// buildStructuredError builds a single NBD_REPLY_TYPE_ERROR chunk, marked
+// as the final chunk.
+func buildStructuredError(handle uint64, errno uint32, message string) []byte {
+	payload := make([]byte, 4+2+len(message))
+	binary.BigEndian.PutUint32(payload[0:4], errno)
+	binary.BigEndian.PutUint16(payload[4:6], uint16(len(message)))
+	copy(payload[6:], message)
+	return buildStructuredChunk(handle, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_ERROR, payload)
+}
+
+// buildStructuredBlockStatus builds a single NBD_REPLY_TYPE_BLOCK_STATUS
+// chunk describing the given extents, marked as the final chunk.
+// contextID is the metadata context id the client negotiated for
+// "base:allocation" via NBD_OPT_SET_META_CONTEXT, which it uses to tell
+// this chunk apart from other metadata contexts it may have negotiated.
+func buildStructuredBlockStatus(handle uint64, contextID uint32, extents []Extent) []byte {
+	payload := make([]byte, 4+8*len(extents))
+	binary.BigEndian.PutUint32(payload[0:4], contextID)
+	for i, e := range extents {
+		o := 4 + i*8
+		binary.BigEndian.PutUint32(payload[o:o+4], e.Length)
+		binary.BigEndian.PutUint32(payload[o+4:o+8], e.Flags)
+	}
+	return buildStructuredChunk(handle, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_BLOCK_STATUS, payload)
+}
@@ -0,0 +1,209 @@
+// This file is part of fs1up.
+// Copyright (C) 2014 Andreas Klauer <Andreas.Klauer@metamorpher.de>
+// License: GPL-2
+
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// parsedChunk is a structured reply chunk decoded back out of
+// buildStructuredChunk's wire format, for assertions in tests.
+type parsedChunk struct {
+	flags   uint16
+	typ     uint16
+	handle  uint64
+	payload []byte
+}
+
+// parseStructuredChunks splits buf, a concatenation of one or more
+// structured reply chunks as built by buildStructuredChunk, back into its
+// individual chunks.
+func parseStructuredChunks(t *testing.T, buf []byte) []parsedChunk {
+	t.Helper()
+	var chunks []parsedChunk
+	for len(buf) > 0 {
+		if len(buf) < 20 {
+			t.Fatalf("trailing %d bytes too short for a chunk header", len(buf))
+		}
+		magic := binary.BigEndian.Uint32(buf[0:4])
+		if magic != structuredReplyMagic {
+			t.Fatalf("chunk magic = %#x, want %#x", magic, structuredReplyMagic)
+		}
+		flags := binary.BigEndian.Uint16(buf[4:6])
+		typ := binary.BigEndian.Uint16(buf[6:8])
+		handle := binary.BigEndian.Uint64(buf[8:16])
+		length := binary.BigEndian.Uint32(buf[16:20])
+		if uint32(len(buf)-20) < length {
+			t.Fatalf("chunk payload length %d exceeds remaining %d bytes", length, len(buf)-20)
+		}
+		chunks = append(chunks, parsedChunk{flags: flags, typ: typ, handle: handle, payload: buf[20 : 20+length]})
+		buf = buf[20+length:]
+	}
+	return chunks
+}
+
+func TestBuildStructuredDone(t *testing.T) {
+	chunks := parseStructuredChunks(t, buildStructuredDone(42))
+	if len(chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1", len(chunks))
+	}
+	c := chunks[0]
+	if c.typ != NBD_REPLY_TYPE_NONE || c.flags != NBD_REPLY_FLAG_DONE || c.handle != 42 || len(c.payload) != 0 {
+		t.Errorf("chunk = %+v, want type NONE, DONE flag, handle 42, no payload", c)
+	}
+}
+
+func TestBuildStructuredData(t *testing.T) {
+	data := []byte("hello")
+	chunks := parseStructuredChunks(t, buildStructuredData(7, 100, data, true))
+	if len(chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1", len(chunks))
+	}
+	c := chunks[0]
+	if c.typ != NBD_REPLY_TYPE_OFFSET_DATA || c.flags != NBD_REPLY_FLAG_DONE {
+		t.Errorf("type/flags = %d/%d, want OFFSET_DATA/DONE", c.typ, c.flags)
+	}
+	if off := binary.BigEndian.Uint64(c.payload[0:8]); off != 100 {
+		t.Errorf("offset = %d, want 100", off)
+	}
+	if !bytes.Equal(c.payload[8:], data) {
+		t.Errorf("payload data = %q, want %q", c.payload[8:], data)
+	}
+}
+
+func TestBuildStructuredHole(t *testing.T) {
+	chunks := parseStructuredChunks(t, buildStructuredHole(7, 200, 4096, false))
+	if len(chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1", len(chunks))
+	}
+	c := chunks[0]
+	if c.typ != NBD_REPLY_TYPE_OFFSET_HOLE || c.flags != 0 {
+		t.Errorf("type/flags = %d/%d, want OFFSET_HOLE/0", c.typ, c.flags)
+	}
+	if off := binary.BigEndian.Uint64(c.payload[0:8]); off != 200 {
+		t.Errorf("offset = %d, want 200", off)
+	}
+	if length := binary.BigEndian.Uint32(c.payload[8:12]); length != 4096 {
+		t.Errorf("length = %d, want 4096", length)
+	}
+}
+
+func TestBuildStructuredError(t *testing.T) {
+	chunks := parseStructuredChunks(t, buildStructuredError(3, 5, "boom"))
+	if len(chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1", len(chunks))
+	}
+	c := chunks[0]
+	if c.typ != NBD_REPLY_TYPE_ERROR || c.flags != NBD_REPLY_FLAG_DONE {
+		t.Errorf("type/flags = %d/%d, want ERROR/DONE", c.typ, c.flags)
+	}
+	if errno := binary.BigEndian.Uint32(c.payload[0:4]); errno != 5 {
+		t.Errorf("errno = %d, want 5", errno)
+	}
+	if msglen := binary.BigEndian.Uint16(c.payload[4:6]); int(msglen) != len("boom") {
+		t.Errorf("message length = %d, want %d", msglen, len("boom"))
+	}
+	if msg := string(c.payload[6:]); msg != "boom" {
+		t.Errorf("message = %q, want %q", msg, "boom")
+	}
+}
+
+func TestBuildStructuredBlockStatus(t *testing.T) {
+	extents := []Extent{{Length: 4096, Flags: NBD_STATE_HOLE | NBD_STATE_ZERO}, {Length: 8192, Flags: 0}}
+	chunks := parseStructuredChunks(t, buildStructuredBlockStatus(9, 1, extents))
+	if len(chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1", len(chunks))
+	}
+	c := chunks[0]
+	if c.typ != NBD_REPLY_TYPE_BLOCK_STATUS || c.flags != NBD_REPLY_FLAG_DONE {
+		t.Errorf("type/flags = %d/%d, want BLOCK_STATUS/DONE", c.typ, c.flags)
+	}
+	if ctxID := binary.BigEndian.Uint32(c.payload[0:4]); ctxID != 1 {
+		t.Errorf("context id = %d, want 1", ctxID)
+	}
+	for i, e := range extents {
+		o := 4 + i*8
+		if length := binary.BigEndian.Uint32(c.payload[o : o+4]); length != e.Length {
+			t.Errorf("extent %d length = %d, want %d", i, length, e.Length)
+		}
+		if flags := binary.BigEndian.Uint32(c.payload[o+4 : o+8]); flags != e.Flags {
+			t.Errorf("extent %d flags = %#x, want %#x", i, flags, e.Flags)
+		}
+	}
+}
+
+// TestBuildStructuredRead exercises the hole/data split NBD_CMD_READ
+// relies on to answer a sparse export without shipping zero bytes over
+// the wire.
+func TestBuildStructuredRead(t *testing.T) {
+	data := bytes.Repeat([]byte{0xaa}, 12)
+
+	t.Run("no extents falls back to one data chunk", func(t *testing.T) {
+		chunks := parseStructuredChunks(t, buildStructuredRead(1, 1000, data, nil))
+		if len(chunks) != 1 {
+			t.Fatalf("got %d chunks, want 1", len(chunks))
+		}
+		c := chunks[0]
+		if c.typ != NBD_REPLY_TYPE_OFFSET_DATA || c.flags != NBD_REPLY_FLAG_DONE {
+			t.Errorf("type/flags = %d/%d, want OFFSET_DATA/DONE", c.typ, c.flags)
+		}
+		if !bytes.Equal(c.payload[8:], data) {
+			t.Errorf("payload data = %v, want %v", c.payload[8:], data)
+		}
+	})
+
+	t.Run("hole and data extents split into separate chunks", func(t *testing.T) {
+		extents := []Extent{
+			{Length: 4, Flags: NBD_STATE_HOLE | NBD_STATE_ZERO},
+			{Length: 8, Flags: 0},
+		}
+		chunks := parseStructuredChunks(t, buildStructuredRead(1, 1000, data, extents))
+		if len(chunks) != 2 {
+			t.Fatalf("got %d chunks, want 2", len(chunks))
+		}
+
+		hole := chunks[0]
+		if hole.typ != NBD_REPLY_TYPE_OFFSET_HOLE || hole.flags != 0 {
+			t.Errorf("chunk 0 type/flags = %d/%d, want OFFSET_HOLE/0 (not done)", hole.typ, hole.flags)
+		}
+		if off := binary.BigEndian.Uint64(hole.payload[0:8]); off != 1000 {
+			t.Errorf("hole offset = %d, want 1000", off)
+		}
+		if length := binary.BigEndian.Uint32(hole.payload[8:12]); length != 4 {
+			t.Errorf("hole length = %d, want 4", length)
+		}
+
+		dataChunk := chunks[1]
+		if dataChunk.typ != NBD_REPLY_TYPE_OFFSET_DATA || dataChunk.flags != NBD_REPLY_FLAG_DONE {
+			t.Errorf("chunk 1 type/flags = %d/%d, want OFFSET_DATA/DONE", dataChunk.typ, dataChunk.flags)
+		}
+		if off := binary.BigEndian.Uint64(dataChunk.payload[0:8]); off != 1004 {
+			t.Errorf("data offset = %d, want 1004", off)
+		}
+		if !bytes.Equal(dataChunk.payload[8:], data[4:]) {
+			t.Errorf("data payload = %v, want %v", dataChunk.payload[8:], data[4:])
+		}
+	})
+
+	t.Run("extents shorter than the read get a trailing data chunk", func(t *testing.T) {
+		extents := []Extent{{Length: 4, Flags: NBD_STATE_HOLE}}
+		chunks := parseStructuredChunks(t, buildStructuredRead(1, 1000, data, extents))
+		if len(chunks) != 2 {
+			t.Fatalf("got %d chunks, want 2", len(chunks))
+		}
+		if chunks[0].typ != NBD_REPLY_TYPE_OFFSET_HOLE {
+			t.Errorf("chunk 0 type = %d, want OFFSET_HOLE", chunks[0].typ)
+		}
+		last := chunks[len(chunks)-1]
+		if last.flags != NBD_REPLY_FLAG_DONE {
+			t.Errorf("last chunk flags = %d, want DONE set", last.flags)
+		}
+		if !bytes.Equal(last.payload[8:], data[4:]) {
+			t.Errorf("trailing data = %v, want %v", last.payload[8:], data[4:])
+		}
+	})
+}
@@ -0,0 +1,331 @@
+// This file is part of fs1up.
+// Copyright (C) 2014 Andreas Klauer <Andreas.Klauer@metamorpher.de>
+// License: GPL-2
+
+package nbd
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Export pairs a Device with the name and size it is published under by
+// a Server.
+type Export struct {
+	Name   string
+	Device Device
+	Size   int64
+}
+
+// Server speaks the NBD newstyle/fixed-newstyle handshake and serves one
+// or more named Exports over TCP. Unlike Client(), which attaches a Device
+// to the Linux kernel NBD driver, Server talks directly to NBD clients
+// such as qemu-nbd or nbdkit.
+type Server struct {
+	Exports []Export
+
+	// Options configures the worker pool that serves each accepted
+	// connection once it reaches the transmission phase. The zero value
+	// picks sane defaults.
+	Options ServerOptions
+}
+
+// ListenAndServe listens on addr and serves incoming NBD connections until
+// the listener returns an error (for example because it was closed).
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := s.serve(conn); err != nil && err != io.EOF {
+				fmt.Println("nbd: client error:", err)
+			}
+		}()
+	}
+}
+
+func (s *Server) export(name string) (*Export, bool) {
+	for i := range s.Exports {
+		if s.Exports[i].Name == name {
+			return &s.Exports[i], true
+		}
+	}
+	return nil, false
+}
+
+// serve drives the handshake for a single client connection and, once an
+// export has been selected, hands the connection off to the transmission
+// phase.
+func (s *Server) serve(conn net.Conn) error {
+	defer conn.Close()
+
+	if err := binary.Write(conn, binary.BigEndian, uint64(nbdMagic)); err != nil {
+		return err
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint64(ihaveopt)); err != nil {
+		return err
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint16(NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES)); err != nil {
+		return err
+	}
+
+	var clientFlags uint32
+	if err := binary.Read(conn, binary.BigEndian, &clientFlags); err != nil {
+		return err
+	}
+
+	var structured bool
+	var metaContextID uint32
+	for {
+		export, sr, mid, err := s.handleOption(conn, clientFlags)
+		if err != nil {
+			return err
+		}
+		if sr {
+			structured = true
+		}
+		if mid != 0 {
+			metaContextID = mid
+		}
+		if export != nil {
+			return s.transmit(conn, export, structured, metaContextID)
+		}
+	}
+}
+
+// handleOption reads and answers a single client option. It returns a
+// non-nil Export once the client has selected one via NBD_OPT_EXPORT_NAME
+// or NBD_OPT_GO, at which point the connection should move into the
+// transmission phase. The second return value reports whether this option
+// was NBD_OPT_STRUCTURED_REPLY, so the caller can remember it across
+// calls. The third return value is non-zero if this option was
+// NBD_OPT_SET_META_CONTEXT and negotiated baseAllocationMetaContext, so
+// the caller can remember the context id the client was told to expect in
+// NBD_CMD_BLOCK_STATUS replies.
+func (s *Server) handleOption(conn net.Conn, clientFlags uint32) (*Export, bool, uint32, error) {
+	var magic uint64
+	if err := binary.Read(conn, binary.BigEndian, &magic); err != nil {
+		return nil, false, 0, err
+	}
+	if magic != ihaveopt {
+		return nil, false, 0, fmt.Errorf("nbd: bad option magic %#x", magic)
+	}
+
+	var opt, length uint32
+	if err := binary.Read(conn, binary.BigEndian, &opt); err != nil {
+		return nil, false, 0, err
+	}
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, false, 0, err
+	}
+	if length > maxOptionLength {
+		return nil, false, 0, fmt.Errorf("nbd: option %d data length %d exceeds limit", opt, length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, false, 0, err
+	}
+
+	switch opt {
+	case NBD_OPT_EXPORT_NAME:
+		export, ok := s.export(string(data))
+		if !ok {
+			// NBD_OPT_EXPORT_NAME has no error reply in the protocol;
+			// the only option is to drop the connection.
+			return nil, false, 0, fmt.Errorf("nbd: unknown export %q", data)
+		}
+		if err := s.sendExportInfo(conn, export, clientFlags&NBD_FLAG_C_NO_ZEROES != 0); err != nil {
+			return nil, false, 0, err
+		}
+		return export, false, 0, nil
+
+	case NBD_OPT_INFO, NBD_OPT_GO:
+		name, err := parseInfoRequest(data)
+		if err != nil {
+			return nil, false, 0, s.sendOptReply(conn, opt, NBD_REP_ERR_INVALID, nil)
+		}
+		export, ok := s.export(name)
+		if !ok {
+			return nil, false, 0, s.sendOptReply(conn, opt, NBD_REP_ERR_UNKNOWN, nil)
+		}
+		if err := s.sendOptReply(conn, opt, NBD_REP_INFO, exportInfoPayload(export)); err != nil {
+			return nil, false, 0, err
+		}
+		if err := s.sendOptReply(conn, opt, NBD_REP_ACK, nil); err != nil {
+			return nil, false, 0, err
+		}
+		if opt == NBD_OPT_GO {
+			return export, false, 0, nil
+		}
+		return nil, false, 0, nil
+
+	case NBD_OPT_STRUCTURED_REPLY:
+		return nil, true, 0, s.sendOptReply(conn, opt, NBD_REP_ACK, nil)
+
+	case NBD_OPT_SET_META_CONTEXT:
+		return s.handleSetMetaContext(conn, opt, data)
+
+	case NBD_OPT_LIST:
+		for i := range s.Exports {
+			payload := append([]byte{}, uint32Bytes(uint32(len(s.Exports[i].Name)))...)
+			payload = append(payload, s.Exports[i].Name...)
+			if err := s.sendOptReply(conn, opt, NBD_REP_SERVER, payload); err != nil {
+				return nil, false, 0, err
+			}
+		}
+		return nil, false, 0, s.sendOptReply(conn, opt, NBD_REP_ACK, nil)
+
+	case NBD_OPT_ABORT:
+		_ = s.sendOptReply(conn, opt, NBD_REP_ACK, nil)
+		return nil, false, 0, io.EOF
+
+	default:
+		return nil, false, 0, s.sendOptReply(conn, opt, NBD_REP_ERR_UNSUP, nil)
+	}
+}
+
+// handleSetMetaContext answers NBD_OPT_SET_META_CONTEXT, through which a
+// client queries which metadata contexts (e.g. "base:allocation") it wants
+// tagged onto NBD_CMD_BLOCK_STATUS replies. This server only ever exposes
+// baseAllocationMetaContext, under baseAllocationContextID; any other
+// queried context is simply not acknowledged, as the protocol allows.
+func (s *Server) handleSetMetaContext(conn net.Conn, opt uint32, data []byte) (*Export, bool, uint32, error) {
+	name, rest, err := parseLengthPrefixed(data)
+	if err != nil {
+		return nil, false, 0, s.sendOptReply(conn, opt, NBD_REP_ERR_INVALID, nil)
+	}
+	if _, ok := s.export(string(name)); !ok {
+		return nil, false, 0, s.sendOptReply(conn, opt, NBD_REP_ERR_UNKNOWN, nil)
+	}
+
+	if len(rest) < 4 {
+		return nil, false, 0, s.sendOptReply(conn, opt, NBD_REP_ERR_INVALID, nil)
+	}
+	count := binary.BigEndian.Uint32(rest[0:4])
+	rest = rest[4:]
+
+	var negotiated uint32
+	for i := uint32(0); i < count; i++ {
+		query, remainder, err := parseLengthPrefixed(rest)
+		if err != nil {
+			return nil, false, 0, s.sendOptReply(conn, opt, NBD_REP_ERR_INVALID, nil)
+		}
+		rest = remainder
+		if string(query) != baseAllocationMetaContext {
+			continue
+		}
+		payload := append(uint32Bytes(baseAllocationContextID), baseAllocationMetaContext...)
+		if err := s.sendOptReply(conn, opt, NBD_REP_META_CONTEXT, payload); err != nil {
+			return nil, false, 0, err
+		}
+		negotiated = baseAllocationContextID
+	}
+	return nil, false, negotiated, s.sendOptReply(conn, opt, NBD_REP_ACK, nil)
+}
+
+// sendExportInfo replies to NBD_OPT_EXPORT_NAME, which (unlike NBD_OPT_GO)
+// has no reply header: just the export size and transmission flags,
+// followed by 124 bytes of zero padding unless the client's
+// NBD_FLAG_C_NO_ZEROES reply told us to skip it.
+func (s *Server) sendExportInfo(conn net.Conn, export *Export, noZeroes bool) error {
+	if err := binary.Write(conn, binary.BigEndian, uint64(export.Size)); err != nil {
+		return err
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint16(deviceFlags(export.Device))); err != nil {
+		return err
+	}
+	if noZeroes {
+		return nil
+	}
+	_, err := conn.Write(make([]byte, 124))
+	return err
+}
+
+func exportInfoPayload(export *Export) []byte {
+	payload := make([]byte, 2+8+2)
+	binary.BigEndian.PutUint16(payload[0:2], NBD_INFO_EXPORT)
+	binary.BigEndian.PutUint64(payload[2:10], uint64(export.Size))
+	binary.BigEndian.PutUint16(payload[10:12], uint16(deviceFlags(export.Device)))
+	return payload
+}
+
+// parseInfoRequest extracts the export name from the body of an
+// NBD_OPT_INFO/NBD_OPT_GO request (export name length + name, followed by
+// a count of requested NBD_INFO_* types that this server ignores).
+func parseInfoRequest(data []byte) (string, error) {
+	name, _, err := parseLengthPrefixed(data)
+	return string(name), err
+}
+
+// parseLengthPrefixed splits off a single "uint32 length + bytes" field,
+// the encoding used throughout option negotiation for export names and
+// metadata context queries, and returns it along with whatever follows.
+func parseLengthPrefixed(data []byte) (field []byte, rest []byte, err error) {
+	if len(data) < 4 {
+		return nil, nil, fmt.Errorf("nbd: short length-prefixed field")
+	}
+	n := binary.BigEndian.Uint32(data[0:4])
+	if uint32(len(data)-4) < n {
+		return nil, nil, fmt.Errorf("nbd: short length-prefixed field")
+	}
+	return data[4 : 4+n], data[4+n:], nil
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// sendOptReply writes one option reply chunk: the option magic, the option
+// being replied to, the reply type and an opaque payload.
+func (s *Server) sendOptReply(conn net.Conn, opt uint32, replyType uint32, payload []byte) error {
+	if err := binary.Write(conn, binary.BigEndian, uint64(optMagic)); err != nil {
+		return err
+	}
+	if err := binary.Write(conn, binary.BigEndian, opt); err != nil {
+		return err
+	}
+	if err := binary.Write(conn, binary.BigEndian, replyType); err != nil {
+		return err
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint32(len(payload))); err != nil {
+		return err
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	_, err := conn.Write(payload)
+	return err
+}
+
+// transmit hands the connection to the existing request/reply loop used by
+// the kernel client path, once a TCP client has selected an export via
+// NBD_OPT_EXPORT_NAME or NBD_OPT_GO. metaContextID is the id the client
+// was told (via NBD_OPT_SET_META_CONTEXT) to expect in
+// NBD_CMD_BLOCK_STATUS replies, or 0 if it never negotiated one.
+func (s *Server) transmit(conn net.Conn, export *Export, structured bool, metaContextID uint32) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return fmt.Errorf("nbd: transmission phase requires a TCP connection")
+	}
+	f, err := tcpConn.File()
+	if err != nil {
+		return err
+	}
+
+	// There is no kernel /dev/nbdN device behind a TCP client, so handle()
+	// has nothing to disconnect on exit; it just closes f.
+	return handle(context.Background(), f, nil, export.Device, structured, metaContextID, s.Options)
+}
@@ -0,0 +1,140 @@
+// This file is part of fs1up.
+// Copyright (C) 2014 Andreas Klauer <Andreas.Klauer@metamorpher.de>
+// License: GPL-2
+
+package nbd
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestParseLengthPrefixed(t *testing.T) {
+	cases := []struct {
+		name    string
+		data    []byte
+		field   string
+		rest    []byte
+		wantErr bool
+	}{
+		{
+			name:  "field with trailing bytes",
+			data:  append(append(uint32Bytes(5), "hello"...), 1, 2, 3),
+			field: "hello",
+			rest:  []byte{1, 2, 3},
+		},
+		{
+			name:  "zero-length field",
+			data:  uint32Bytes(0),
+			field: "",
+			rest:  []byte{},
+		},
+		{
+			name:    "missing length",
+			data:    []byte{0, 0, 1},
+			wantErr: true,
+		},
+		{
+			name:    "length exceeds remaining data",
+			data:    append(uint32Bytes(10), "short"...),
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			field, rest, err := parseLengthPrefixed(c.data)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("parseLengthPrefixed(%v) = nil error, want one", c.data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLengthPrefixed(%v): %v", c.data, err)
+			}
+			if string(field) != c.field {
+				t.Errorf("field = %q, want %q", field, c.field)
+			}
+			if string(rest) != string(c.rest) {
+				t.Errorf("rest = %v, want %v", rest, c.rest)
+			}
+		})
+	}
+}
+
+func TestParseInfoRequest(t *testing.T) {
+	data := append(uint32Bytes(4), "test"...)
+	data = append(data, uint32Bytes(0)...) // zero requested NBD_INFO_* types
+
+	name, err := parseInfoRequest(data)
+	if err != nil {
+		t.Fatalf("parseInfoRequest: %v", err)
+	}
+	if name != "test" {
+		t.Errorf("name = %q, want %q", name, "test")
+	}
+
+	if _, err := parseInfoRequest([]byte{0, 0}); err == nil {
+		t.Error("parseInfoRequest on truncated data: got nil error, want one")
+	}
+}
+
+// TestSendExportInfoZeroPadding checks that sendExportInfo writes the 124
+// bytes of zero padding NBD_OPT_EXPORT_NAME's reply requires unless the
+// client asked to skip them via NBD_FLAG_C_NO_ZEROES.
+func TestSendExportInfoZeroPadding(t *testing.T) {
+	for _, noZeroes := range []bool{false, true} {
+		t.Run("", func(t *testing.T) {
+			client, srv := net.Pipe()
+
+			export := &Export{Name: "test", Device: newBenchDevice(4096), Size: 4096}
+
+			errc := make(chan error, 1)
+			go func() {
+				errc <- (&Server{}).sendExportInfo(srv, export, noZeroes)
+				srv.Close()
+			}()
+
+			var size uint64
+			if err := binary.Read(client, binary.BigEndian, &size); err != nil {
+				t.Fatalf("reading size: %v", err)
+			}
+			if size != uint64(export.Size) {
+				t.Errorf("size = %d, want %d", size, export.Size)
+			}
+
+			var flags uint16
+			if err := binary.Read(client, binary.BigEndian, &flags); err != nil {
+				t.Fatalf("reading flags: %v", err)
+			}
+
+			// Whatever comes after the flags, up to srv.Close(), is the
+			// padding (or lack of it).
+			padding, err := io.ReadAll(client)
+			if err != nil {
+				t.Fatalf("reading padding: %v", err)
+			}
+			if noZeroes {
+				if len(padding) != 0 {
+					t.Fatalf("got %d padding bytes with NO_ZEROES set, want none", len(padding))
+				}
+			} else {
+				if len(padding) != 124 {
+					t.Fatalf("got %d padding bytes, want 124", len(padding))
+				}
+				for i, b := range padding {
+					if b != 0 {
+						t.Fatalf("padding[%d] = %#x, want 0", i, b)
+					}
+				}
+			}
+
+			if err := <-errc; err != nil {
+				t.Fatalf("sendExportInfo: %v", err)
+			}
+		})
+	}
+}